@@ -0,0 +1,63 @@
+package reversehttp
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Authenticator authenticates an inbound poll and returns an opaque
+// identity for the caller. It is invoked on every poll of a session
+// (not just the first), so that Server can confirm later polls still
+// present credentials for the same identity the session was created
+// with. Returning an *AuthError lets the hook set a WWW-Authenticate
+// challenge on the resulting 401 response.
+type Authenticator func(r *http.Request) (identity string, err error)
+
+// AuthError is the error an Authenticator should return to have the
+// server add a WWW-Authenticate challenge to the 401 it sends back.
+type AuthError struct {
+	WWWAuthenticate string
+	Err             error
+}
+
+func (e *AuthError) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return "reversehttp: authentication failed"
+}
+
+func (e *AuthError) Unwrap() error { return e.Err }
+
+// BearerAuthenticator builds an Authenticator that expects an
+// "Authorization: Bearer <token>" header and resolves the token to an
+// identity with lookup.
+func BearerAuthenticator(lookup func(token string) (identity string, ok bool)) Authenticator {
+	const challenge = `Bearer realm="reversehttp"`
+	return func(r *http.Request) (string, error) {
+		auth := r.Header.Get("Authorization")
+		const prefix = "Bearer "
+		if !strings.HasPrefix(auth, prefix) {
+			return "", &AuthError{WWWAuthenticate: challenge, Err: errors.New("missing bearer token")}
+		}
+
+		identity, ok := lookup(strings.TrimPrefix(auth, prefix))
+		if !ok {
+			return "", &AuthError{WWWAuthenticate: challenge, Err: errors.New("invalid bearer token")}
+		}
+		return identity, nil
+	}
+}
+
+// MTLSAuthenticator builds an Authenticator that identifies the caller
+// by the subject common name of the client certificate it presented
+// during the TLS handshake.
+func MTLSAuthenticator() Authenticator {
+	return func(r *http.Request) (string, error) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			return "", &AuthError{Err: errors.New("no client certificate presented")}
+		}
+		return r.TLS.PeerCertificates[0].Subject.CommonName, nil
+	}
+}
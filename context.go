@@ -0,0 +1,59 @@
+package reversehttp
+
+import (
+	"context"
+	"sync"
+)
+
+// cancelRegistry tracks the context.CancelFunc for each in-flight
+// stream on the client side of a connection, so that a cancel frame
+// arriving for a stream ID can abort the matching handler. A cancel
+// that arrives before the matching request does (the two race over the
+// wire) is remembered and applied as soon as the stream is registered.
+type cancelRegistry struct {
+	mu        sync.Mutex
+	cancels   map[uint32]context.CancelFunc
+	preCancel map[uint32]bool
+}
+
+func newCancelRegistry() *cancelRegistry {
+	return &cancelRegistry{
+		cancels:   map[uint32]context.CancelFunc{},
+		preCancel: map[uint32]bool{},
+	}
+}
+
+// register records cancel as the way to abort streamID. It returns
+// false if a cancel frame for streamID already arrived, in which case
+// the caller should invoke cancel itself right away.
+func (r *cancelRegistry) register(streamID uint32, cancel context.CancelFunc) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.preCancel[streamID] {
+		delete(r.preCancel, streamID)
+		return false
+	}
+	r.cancels[streamID] = cancel
+	return true
+}
+
+// cancel aborts streamID if it's registered, or remembers that it
+// should be aborted as soon as it is.
+func (r *cancelRegistry) cancel(streamID uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cancel, ok := r.cancels[streamID]; ok {
+		cancel()
+		delete(r.cancels, streamID)
+		return
+	}
+	r.preCancel[streamID] = true
+}
+
+// done forgets streamID once its handler has finished.
+func (r *cancelRegistry) done(streamID uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.cancels, streamID)
+	delete(r.preCancel, streamID)
+}
@@ -5,41 +5,89 @@
 // server for requests. The request is passed to the handler on the
 // client, and the response is passed back to the server.
 //
-// Although the scheme doesn't preclude pipelining, only one
-// request/response pair can be in flight at a time for now.
-//
+// Many requests can be in flight at once over a single session: each
+// Request is tagged with a stream ID (in the style of HTTP/2) so that
+// the poll in either direction can carry several framed HTTP messages
+// instead of exactly one.
 package reversehttp
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	uuid "github.com/satori/go.uuid"
 )
 
+// frame kinds distinguish a framed HTTP message from a bare
+// notification that a stream should be aborted or has finished.
+const (
+	frameData   byte = 0 // a chunk of an HTTP request, response header block, or response body
+	frameCancel byte = 1 // the caller gave up on this stream; stop working on it
+	frameEnd    byte = 2 // the response body for this stream is complete
+)
+
 type Response struct {
 	Err  error
 	HTTP *http.Response
 }
 
 type Request struct {
+	StreamID uint32
 	HTTP     *http.Request
 	Response chan Response
 }
 
 type Session struct {
-	handlerMu sync.Mutex // one request at a time
-
-	PendingRequest *Request
-	Requests       chan Request
-	closed         chan struct{}
-	closer         *time.Timer
+	handlerMu sync.Mutex // serializes poll exchanges on this session
+
+	// Identity is the value Server.Authenticator returned when this
+	// session was created. It's empty if the server has no
+	// Authenticator configured.
+	Identity string
+
+	// maxConcurrentStreams caps how many requests may be in flight over
+	// this session at once. It's accessed atomically: Server.OnConnect
+	// runs in its own goroutine with no happens-before edge against the
+	// session's first poll, so a plain int field here would race.
+	// MaxConcurrentStreams/SetMaxConcurrentStreams are the public API;
+	// the zero value means 1, preserving the original
+	// one-request-at-a-time behavior.
+	maxConcurrentStreams int32
+
+	pendingMu sync.Mutex
+	pending   map[uint32]*Request
+
+	// streams holds the body buffer for each response that's in the
+	// middle of streaming: the first response frame for a stream
+	// delivers headers and opens the streamBody, later frames feed it,
+	// and a frameEnd frame closes it.
+	streams map[uint32]*streamBody
+
+	// cancels carries stream IDs whose caller gave up, so a transport
+	// can tell the remote handler to stop working on them.
+	cancels chan uint32
+
+	inFlight     sync.WaitGroup
+	shutdownOnce sync.Once
+	shuttingDown chan struct{}
+
+	Requests chan Request
+	closed   chan struct{}
+	closer   *time.Timer
+
+	streamSeq uint32
 }
 
 func (s *Session) Close() {
@@ -47,23 +95,167 @@ func (s *Session) Close() {
 	close(s.Requests)
 }
 
+// MaxConcurrentStreams returns the cap on requests in flight over s at
+// once, defaulting to 1 if SetMaxConcurrentStreams was never called.
+func (s *Session) MaxConcurrentStreams() int {
+	n := atomic.LoadInt32(&s.maxConcurrentStreams)
+	if n < 1 {
+		return 1
+	}
+	return int(n)
+}
+
+// SetMaxConcurrentStreams sets the cap on requests in flight over s at
+// once. It's safe to call concurrently with a transport reading the
+// cap, including from Server.OnConnect racing the session's first poll.
+func (s *Session) SetMaxConcurrentStreams(n int) {
+	atomic.StoreInt32(&s.maxConcurrentStreams, int32(n))
+}
+
 var ErrSessionClosed = errors.New("session closed")
 
 func (s *Session) RoundTrip(r *http.Request) (*http.Response, error) {
 	select {
-	case _, _ = <-s.closed:
+	case <-s.closed:
+		return nil, ErrSessionClosed
+	default:
+	}
+	select {
+	case <-s.shuttingDown:
 		return nil, ErrSessionClosed
 	default:
 	}
 
+	s.inFlight.Add(1)
+	defer s.inFlight.Done()
+
 	req := Request{
+		StreamID: atomic.AddUint32(&s.streamSeq, 1),
 		HTTP:     r,
-		Response: make(chan Response),
+		Response: make(chan Response, 1),
+	}
+
+	ctx := r.Context()
+
+	// don't let a caller that gives up before a poll ever picks up req
+	// block here waiting for one to show up.
+	select {
+	case s.Requests <- req:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.closed:
+		return nil, ErrSessionClosed
+	}
+
+	select {
+	case resp := <-req.Response:
+		return resp.HTTP, resp.Err
+	case <-ctx.Done():
+		// req may already be on the wire, so tell the remote end to stop
+		// working on it. s.cancels may be full; deliver it in the
+		// background rather than drop it, so a burst of cancellations
+		// never goes silently missing.
+		go func(streamID uint32) {
+			select {
+			case s.cancels <- streamID:
+			case <-s.closed:
+			}
+		}(req.StreamID)
+		return nil, ctx.Err()
+	case <-s.closed:
+		return nil, ErrSessionClosed
+	}
+}
+
+// Shutdown stops s from accepting new requests, waits for requests
+// already in flight to finish (bounded by ctx), then closes the
+// session. It mirrors http.Server.Shutdown.
+func (s *Session) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() { close(s.shuttingDown) })
+
+	done := make(chan struct{})
+	go func() {
+		s.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-s.closed:
+	default:
+		s.Close()
+	}
+	return nil
+}
+
+// encodeFrame lays out a single frame as a 4-byte big-endian payload
+// length, a 4-byte big-endian stream ID, a 1-byte frame kind, then the
+// payload itself.
+func encodeFrame(streamID uint32, kind byte, payload []byte) []byte {
+	frame := make([]byte, 9+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], streamID)
+	frame[8] = kind
+	copy(frame[9:], payload)
+	return frame
+}
+
+// decodeFrame parses a single frame previously built by encodeFrame.
+func decodeFrame(b []byte) (streamID uint32, kind byte, payload []byte, err error) {
+	if len(b) < 9 {
+		return 0, 0, nil, fmt.Errorf("reversehttp: frame too short")
+	}
+	length := binary.BigEndian.Uint32(b[0:4])
+	streamID = binary.BigEndian.Uint32(b[4:8])
+	kind = b[8]
+	if uint32(len(b)-9) < length {
+		return 0, 0, nil, fmt.Errorf("reversehttp: frame truncated")
+	}
+	return streamID, kind, b[9 : 9+length], nil
+}
+
+// writeFrame writes a single frame to w. The frame is built in memory
+// and written with one Write call so that concurrent writers sharing a
+// single destination (see ConnectAndServe) don't interleave frames.
+func writeFrame(w io.Writer, streamID uint32, kind byte, payload []byte) error {
+	_, err := w.Write(encodeFrame(streamID, kind, payload))
+	return err
+}
+
+// readFrame reads one frame written by writeFrame from a streaming
+// source such as an HTTP request or response body.
+func readFrame(r *bufio.Reader) (streamID uint32, kind byte, payload []byte, err error) {
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, nil, err
 	}
-	s.Requests <- req
+	length := binary.BigEndian.Uint32(header[0:4])
+	streamID = binary.BigEndian.Uint32(header[4:8])
+	kind = header[8]
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, 0, nil, err
+	}
+	return streamID, kind, payload, nil
+}
 
-	resp := <-req.Response
-	return resp.HTTP, resp.Err
+// syncWriter serializes Write calls from multiple goroutines onto a
+// single underlying writer, so framed responses from concurrent
+// handlers don't tear.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (sw *syncWriter) Write(b []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.w.Write(b)
 }
 
 type Server struct {
@@ -73,8 +265,21 @@ type Server struct {
 
 	OnConnect func(*Session)
 
-	doInit   sync.Once
-	sessions map[string]*Session
+	// Transport serves sessions whose requests don't ask to be
+	// upgraded to a WebSocket. It defaults to PollTransport{}.
+	Transport Transport
+
+	// Authenticator, if set, is consulted on every poll. A session is
+	// bound to the identity its first poll resolved to; later polls
+	// whose credentials resolve to a different identity are rejected,
+	// so an X-Session value alone isn't enough to take over a session.
+	Authenticator Authenticator
+
+	doInit       sync.Once
+	shutdownOnce sync.Once
+	shuttingDown chan struct{}
+	sessionsMu   sync.Mutex
+	sessions     map[string]*Session
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -86,15 +291,56 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if s.SessionIdleTimeout == 0 {
 			s.SessionIdleTimeout = 10 * time.Minute
 		}
+		if s.Transport == nil {
+			s.Transport = PollTransport{}
+		}
 	})
 
+	s.sessionsMu.Lock()
+	if s.shuttingDown == nil {
+		s.shuttingDown = make(chan struct{})
+	}
+	s.sessionsMu.Unlock()
+
+	var identity string
+	if s.Authenticator != nil {
+		var err error
+		identity, err = s.Authenticator(r)
+		if err != nil {
+			if authErr, ok := err.(*AuthError); ok && authErr.WWWAuthenticate != "" {
+				w.Header().Set("WWW-Authenticate", authErr.WWWAuthenticate)
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
 	sessionID := r.Header.Get("X-Session")
+
+	s.sessionsMu.Lock()
 	session := s.sessions[sessionID]
+	if session != nil && s.Authenticator != nil && session.Identity != identity {
+		s.sessionsMu.Unlock()
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
 	if session == nil {
+		select {
+		case <-s.shuttingDown:
+			s.sessionsMu.Unlock()
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		default:
+		}
 		sessionID = uuid.NewV4().String()
 		session = &Session{
-			closed:   make(chan struct{}),
-			Requests: make(chan Request),
+			Identity:     identity,
+			closed:       make(chan struct{}),
+			shuttingDown: make(chan struct{}),
+			Requests:     make(chan Request),
+			pending:      map[uint32]*Request{},
+			streams:      map[uint32]*streamBody{},
+			cancels:      make(chan uint32, 8),
 		}
 		if s.sessions == nil {
 			s.sessions = map[string]*Session{}
@@ -104,6 +350,7 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			go s.OnConnect(session)
 		}
 	}
+	s.sessionsMu.Unlock()
 	w.Header().Add("X-Session", sessionID)
 
 	session.handlerMu.Lock()
@@ -114,25 +361,71 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		session.closer.Stop()
 	}
 	session.closer = time.AfterFunc(s.SessionIdleTimeout, func() {
-
+		s.sessionsMu.Lock()
 		session := s.sessions[sessionID]
+		delete(s.sessions, sessionID)
+		s.sessionsMu.Unlock()
+
 		if session != nil {
 			log.Printf("closing idle session")
 			session.Close()
-			delete(s.sessions, sessionID)
 		}
 	})
 
-	if session.PendingRequest != nil {
-		resp, err := http.ReadResponse(bufio.NewReader(r.Body), session.PendingRequest.HTTP)
-		if err != nil {
-			session.PendingRequest.Response <- Response{Err: err}
-			w.WriteHeader(http.StatusBadRequest)
-			return
+	transport := s.Transport
+	if isWebSocketUpgrade(r) {
+		transport = WebSocketTransport{}
+	}
+	transport.ServeSession(s, session, w, r)
+}
+
+// Shutdown stops s from accepting connections for new sessions, waits
+// for every existing session to drain (bounded by ctx), then returns.
+// It mirrors http.Server.Shutdown.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.sessionsMu.Lock()
+	if s.shuttingDown == nil {
+		s.shuttingDown = make(chan struct{})
+	}
+	s.sessionsMu.Unlock()
+	s.shutdownOnce.Do(func() { close(s.shuttingDown) })
+
+	s.sessionsMu.Lock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.sessionsMu.Unlock()
+
+	for _, session := range sessions {
+		if err := session.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PollTransport is the original transport: the client POSTs to pick up
+// the next request and, on its next POST, delivers the response. It
+// satisfies Transport.
+type PollTransport struct{}
+
+func (PollTransport) ServeSession(srv *Server, session *Session, w http.ResponseWriter, r *http.Request) {
+	// the POST body, if any, is a stream of framed HTTP responses,
+	// one per stream ID that was outstanding.
+	if r.Body != nil {
+		br := bufio.NewReader(r.Body)
+		for {
+			streamID, kind, payload, err := readFrame(br)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			dispatchResponseFrame(session, streamID, kind, payload)
 		}
-		session.PendingRequest.Response <- Response{HTTP: resp}
-		close(session.PendingRequest.Response)
-		session.PendingRequest = nil
 	}
 
 	// figure out what the polling timeout should be
@@ -147,18 +440,21 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 		}
-		if timeout > s.LongPollMaxTimeout {
+		if timeout > srv.LongPollMaxTimeout {
 			w.Header().Add("X-Warning", fmt.Sprintf("timeout value too high, forcing to maximum %s",
-				s.LongPollMaxTimeout.String()))
-			timeout = s.LongPollMaxTimeout
+				srv.LongPollMaxTimeout.String()))
+			timeout = srv.LongPollMaxTimeout
 		}
-		if timeout < s.LongPollMinTimeout {
+		if timeout < srv.LongPollMinTimeout {
 			w.Header().Add("X-Warning", fmt.Sprintf("timeout value too low, forcing to minimum %s",
-				s.LongPollMinTimeout.String()))
-			timeout = s.LongPollMinTimeout
+				srv.LongPollMinTimeout.String()))
+			timeout = srv.LongPollMinTimeout
 		}
 	}
 
+	maxStreams := session.MaxConcurrentStreams()
+
+	var reqs []Request
 	select {
 	case _ = <-time.After(timeout):
 		w.WriteHeader(http.StatusNoContent)
@@ -169,21 +465,74 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusGone)
 			return
 		}
+		reqs = append(reqs, req)
+	}
 
-		w.Header().Add("Content-type", "application/x-http-request")
-		w.WriteHeader(http.StatusOK)
-		if err := req.HTTP.Write(w); err != nil {
+	// opportunistically grab any other requests that are already
+	// waiting, up to the concurrency limit, without blocking further.
+	for len(reqs) < maxStreams {
+		select {
+		case req, ok := <-session.Requests:
+			if !ok {
+				goto gathered
+			}
+			reqs = append(reqs, req)
+		default:
+			goto gathered
+		}
+	}
+gathered:
+
+	streamIDs := make([]string, len(reqs))
+	for i, req := range reqs {
+		streamIDs[i] = strconv.FormatUint(uint64(req.StreamID), 10)
+	}
+	w.Header().Add("Content-type", "application/x-http-request")
+	w.Header().Set("X-Stream", strings.Join(streamIDs, ","))
+	w.WriteHeader(http.StatusOK)
+
+	for _, req := range reqs {
+		var buf bytes.Buffer
+		if err := req.HTTP.Write(&buf); err != nil {
 			req.Response <- Response{Err: err}
+			continue
+		}
+
+		rememberPending(session, req)
+
+		if err := writeFrame(w, req.StreamID, frameData, buf.Bytes()); err != nil {
+			return
+		}
+	}
+
+	// flush along any cancellations that piled up while we weren't
+	// looking. Every handler from an earlier poll has already returned
+	// by now (the client ends the POST body read above only once they
+	// have), so a cancel frame here can stop only a stream sent in this
+	// same response; for earlier streams it reaches no running handler.
+	for {
+		select {
+		case streamID := <-session.cancels:
+			if err := writeFrame(w, streamID, frameCancel, nil); err != nil {
+				return
+			}
+		default:
 			return
 		}
-		session.PendingRequest = &req
 	}
 }
 
+// ResponseWriter adapts the net/http ResponseWriter interface to a
+// raw io.Writer that carries an HTTP/1.1 response across the reverse
+// channel. Unless the handler sets Content-Length itself, the body is
+// sent chunked, so a handler that calls Flush mid-response (server-sent
+// events, progressive JSON, ...) has its output delivered immediately
+// instead of being held until the handler returns.
 type ResponseWriter struct {
-	w          io.WriteCloser
+	w          io.Writer
 	header     http.Header
 	headerSent bool
+	chunked    bool
 }
 
 func (rw *ResponseWriter) Header() http.Header {
@@ -197,21 +546,95 @@ func (rw *ResponseWriter) Write(b []byte) (int, error) {
 	if !rw.headerSent {
 		rw.WriteHeader(http.StatusOK)
 	}
+	if rw.chunked {
+		return rw.writeChunk(b)
+	}
 	return rw.w.Write(b)
 }
 
 func (rw *ResponseWriter) WriteHeader(statusCode int) {
+	if rw.headerSent {
+		return
+	}
+	if rw.Header().Get("Content-Length") == "" {
+		rw.chunked = true
+		rw.header.Set("Transfer-Encoding", "chunked")
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/1.1 %d %s\r\n", statusCode, http.StatusText(statusCode))
+	rw.header.Write(&buf)
+	fmt.Fprintf(&buf, "\r\n")
+	rw.headerSent = true
+	rw.w.Write(buf.Bytes())
+}
+
+// Flush implements http.Flusher. Each Write already reaches the other
+// end of the reverse channel as its own frame (see frameFlusher), so
+// there's no local buffering to push out; Flush only has to make sure
+// headers went out even if the handler hasn't written a body yet.
+func (rw *ResponseWriter) Flush() {
 	if !rw.headerSent {
-		fmt.Fprintf(rw.w, "HTTP/1.1 %d %s\r\n", statusCode, http.StatusText(statusCode))
-		rw.header.Write(rw.w)
-		fmt.Fprintf(rw.w, "\r\n")
-		rw.headerSent = true
+		rw.WriteHeader(http.StatusOK)
 	}
 }
 
+// finish writes the chunked-encoding terminator, if the body was sent
+// chunked. It must be called once the handler has returned.
+func (rw *ResponseWriter) finish() {
+	if !rw.headerSent {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.chunked {
+		io.WriteString(rw.w, "0\r\n\r\n")
+	}
+}
+
+func (rw *ResponseWriter) writeChunk(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%x\r\n", len(b))
+	buf.Write(b)
+	buf.WriteString("\r\n")
+	if _, err := rw.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// frameFlusher turns each Write into its own wire frame for streamID,
+// so a handler's output (and the header block that precedes it) is
+// carried across the reverse channel as soon as it's produced.
+type frameFlusher struct {
+	streamID  uint32
+	sendFrame func(streamID uint32, kind byte, payload []byte) error
+}
+
+func (f *frameFlusher) Write(b []byte) (int, error) {
+	if err := f.sendFrame(f.streamID, frameData, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ConnectAndServe connects to url and runs handler for every request
+// the server sends, until the session ends or an error occurs. It
+// tries to upgrade to a persistent WebSocket connection first; if the
+// server doesn't support that, it transparently falls back to the
+// original POST-based long-polling loop.
 func ConnectAndServe(httpClient *http.Client, url string, handler http.Handler) error {
+	if conn, _, err := dialWebSocket(url); err == nil {
+		return serveWebSocket(conn, handler)
+	}
+	return pollConnectAndServe(httpClient, url, handler)
+}
+
+func pollConnectAndServe(httpClient *http.Client, url string, handler http.Handler) error {
 	var pollTimeout = time.Minute
 	var sessionID string
+	cancels := newCancelRegistry()
 
 	req, _ := http.NewRequest("POST", url, nil)
 	req.Header.Add("X-Timeout", pollTimeout.String())
@@ -239,18 +662,58 @@ func ConnectAndServe(httpClient *http.Client, url string, handler http.Handler)
 			return fmt.Errorf("%s", resp.Status)
 		}
 
-		serverReq, err := http.ReadRequest(bufio.NewReader(resp.Body))
-		if err != nil {
-			return err
-		}
-
+		// the response body is a stream of framed HTTP requests, one
+		// per stream ID. Each is handled in its own goroutine, and the
+		// framed responses are written back as they complete, in
+		// whatever order the handlers finish.
 		reqBodyReader, reqBodyWriter := io.Pipe()
+		sw := &syncWriter{w: reqBodyWriter}
+
+		var wg sync.WaitGroup
+		br := bufio.NewReader(resp.Body)
+		for {
+			streamID, kind, payload, err := readFrame(br)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
 
-		go func() {
-			rw := &ResponseWriter{
-				w: reqBodyWriter,
+			if kind == frameCancel {
+				cancels.cancel(streamID)
+				continue
 			}
-			handler.ServeHTTP(rw, serverReq)
+
+			serverReq, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(payload)))
+			if err != nil {
+				return err
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			if !cancels.register(streamID, cancel) {
+				cancel()
+			}
+			serverReq = serverReq.WithContext(ctx)
+
+			wg.Add(1)
+			go func(streamID uint32, serverReq *http.Request) {
+				defer wg.Done()
+				defer cancels.done(streamID)
+				rw := &ResponseWriter{w: &frameFlusher{
+					streamID: streamID,
+					sendFrame: func(streamID uint32, kind byte, payload []byte) error {
+						return writeFrame(sw, streamID, kind, payload)
+					},
+				}}
+				handler.ServeHTTP(rw, serverReq)
+				rw.finish()
+				writeFrame(sw, streamID, frameEnd, nil)
+			}(streamID, serverReq)
+		}
+
+		go func() {
+			wg.Wait()
 			reqBodyWriter.Close()
 		}()
 
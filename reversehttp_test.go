@@ -1,12 +1,16 @@
 package reversehttp
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -51,6 +55,63 @@ func TestFunctionality(t *testing.T) {
 	<-done
 }
 
+func TestMaxConcurrentStreams(t *testing.T) {
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	done := make(chan struct{})
+
+	server := Server{
+		OnConnect: func(session *Session) {
+			session.SetMaxConcurrentStreams(2)
+			revClient := http.Client{Transport: session}
+
+			var wg sync.WaitGroup
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					req, _ := http.NewRequest("FROB", "/grob", nil)
+					resp, err := revClient.Do(req)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					resp.Body.Close()
+				}()
+			}
+			wg.Wait()
+			close(done)
+		},
+	}
+
+	serverSock, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(serverSock, &server)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		select {
+		case <-release:
+		case <-time.After(2 * time.Second):
+			t.Error("timed out waiting for both requests to be in flight together")
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	serverURL := fmt.Sprintf("http://%s/", serverSock.Addr())
+	go ConnectAndServe(http.DefaultClient, serverURL, &handler)
+
+	// neither handler invocation is allowed to finish until both have
+	// started, proving they were genuinely in flight at the same time.
+	<-started
+	<-started
+	close(release)
+
+	<-done
+}
+
 func TestPollTimeout(t *testing.T) {
 	done := make(chan struct{})
 	server := Server{
@@ -251,3 +312,285 @@ func TestBadTimeoutValues(t *testing.T) {
 		}
 	}
 }
+
+func TestToWebSocketURL(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "http://example.com/foo", want: "ws://example.com/foo"},
+		{in: "https://example.com/foo", want: "wss://example.com/foo"},
+		{in: "ftp://example.com/foo", wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := toWebSocketURL(c.in)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("toWebSocketURL(%q): expected an error, got %q", c.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("toWebSocketURL(%q): unexpected error: %v", c.in, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("toWebSocketURL(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestDialWebSocketFallback(t *testing.T) {
+	// a plain HTTP server that knows nothing about WebSocket upgrades:
+	// dialWebSocket must fail cleanly so ConnectAndServe can fall back
+	// to polling instead of hanging.
+	plain := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	serverSock, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(serverSock, plain)
+
+	serverURL := fmt.Sprintf("http://%s/", serverSock.Addr())
+	if _, _, err := dialWebSocket(serverURL); err == nil {
+		t.Error("expected dialWebSocket to fail against a server that doesn't speak WebSocket")
+	}
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	done := make(chan struct{})
+	server := Server{
+		OnConnect: func(session *Session) {
+			revClient := http.Client{Transport: session}
+			req, _ := http.NewRequest("FROB", "/grob", nil)
+			resp, err := revClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("expected StatusOK, got %s", resp.Status)
+			}
+			close(done)
+		},
+	}
+
+	serverSock, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(serverSock, &server)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	serverURL := fmt.Sprintf("http://%s/", serverSock.Addr())
+	conn, _, err := dialWebSocket(serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveWebSocket(conn, &handler)
+
+	<-done
+}
+
+func TestStreamingResponse(t *testing.T) {
+	firstChunkRead := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+
+	server := Server{
+		OnConnect: func(session *Session) {
+			revClient := http.Client{Transport: session}
+			req, _ := http.NewRequest("FROB", "/stream", nil)
+			resp, err := revClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			// the handler is still blocked waiting on release at this
+			// point; reading this much of the body without it proves
+			// RoundTrip handed back a response before the handler had
+			// finished (and before its second Write had run).
+			buf := make([]byte, len("first"))
+			if _, err := io.ReadFull(resp.Body, buf); err != nil {
+				t.Fatal(err)
+			}
+			if string(buf) != "first" {
+				t.Errorf("expected first chunk %q, got %q", "first", string(buf))
+			}
+			close(firstChunkRead)
+
+			rest, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(rest) != "second" {
+				t.Errorf("expected remaining body %q, got %q", "second", string(rest))
+			}
+			close(done)
+		},
+	}
+
+	serverSock, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(serverSock, &server)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("second"))
+	})
+
+	serverURL := fmt.Sprintf("http://%s/", serverSock.Addr())
+	go ConnectAndServe(http.DefaultClient, serverURL, &handler)
+
+	<-firstChunkRead
+	close(release)
+	<-done
+}
+
+func TestRoundTripCancellation(t *testing.T) {
+	done := make(chan struct{})
+	server := Server{
+		OnConnect: func(session *Session) {
+			revClient := http.Client{Transport: session}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				time.Sleep(20 * time.Millisecond)
+				cancel()
+			}()
+
+			req, _ := http.NewRequest("FROB", "/slow", nil)
+			_, err := revClient.Do(req.WithContext(ctx))
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("expected context.Canceled, got %v", err)
+			}
+			close(done)
+		},
+	}
+
+	serverSock, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(serverSock, &server)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond) // slower than the client's cancellation
+		w.WriteHeader(http.StatusOK)
+	})
+
+	serverURL := fmt.Sprintf("http://%s/", serverSock.Addr())
+	go ConnectAndServe(http.DefaultClient, serverURL, &handler)
+
+	<-done
+}
+
+func TestAuthenticator(t *testing.T) {
+	connected := make(chan struct{})
+	server := Server{
+		LongPollMaxTimeout: 50 * time.Millisecond,
+		Authenticator: func(r *http.Request) (string, error) {
+			if r.Header.Get("Authorization") == "Bearer other-token" {
+				return "bob", nil
+			}
+			if r.Header.Get("Authorization") != "Bearer good-token" {
+				return "", &AuthError{WWWAuthenticate: `Bearer realm="test"`, Err: errors.New("bad token")}
+			}
+			return "alice", nil
+		},
+		OnConnect: func(session *Session) {
+			if session.Identity != "alice" {
+				t.Errorf("expected session Identity %q, got %q", "alice", session.Identity)
+			}
+			close(connected)
+		},
+	}
+
+	serverSock, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(serverSock, &server)
+	serverURL := fmt.Sprintf("http://%s/", serverSock.Addr())
+
+	// no credentials: rejected with a WWW-Authenticate challenge.
+	req, _ := http.NewRequest("POST", serverURL, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected StatusUnauthorized, got %s", resp.Status)
+	}
+	if resp.Header.Get("WWW-Authenticate") != `Bearer realm="test"` {
+		t.Errorf("expected WWW-Authenticate challenge, got %q", resp.Header.Get("WWW-Authenticate"))
+	}
+
+	// good credentials: session is created and bound to "alice".
+	req, _ = http.NewRequest("POST", serverURL, nil)
+	req.Header.Set("Authorization", "Bearer good-token")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionID := resp.Header.Get("X-Session")
+	if sessionID == "" {
+		t.Fatal("expected a session to be created")
+	}
+	<-connected
+
+	// same session, but credentials now resolve to a different identity:
+	// rejected, since an X-Session value alone shouldn't be enough to
+	// take over someone else's session.
+	req, _ = http.NewRequest("POST", serverURL, nil)
+	req.Header.Set("X-Session", sessionID)
+	req.Header.Set("Authorization", "Bearer other-token")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected StatusUnauthorized for mismatched identity, got %s", resp.Status)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	connected := make(chan struct{})
+	server := Server{
+		OnConnect: func(session *Session) {
+			close(connected)
+		},
+	}
+
+	serverSock, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(serverSock, &server)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	serverURL := fmt.Sprintf("http://%s/", serverSock.Addr())
+	go ConnectAndServe(http.DefaultClient, serverURL, &handler)
+
+	<-connected
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("expected Shutdown to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,368 @@
+package reversehttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// closeWriteWait bounds how long WebSocketTransport waits to write the
+// close frame that tells the remote end a session is gone on purpose.
+const closeWriteWait = 5 * time.Second
+
+// Transport is how a Session's request/response frames actually get
+// carried between Server and the remote ConnectAndServe client.
+// PollTransport is the original POST-based long-polling loop;
+// WebSocketTransport multiplexes the same frames over one persistent
+// connection. Server picks a Transport per inbound request (based on
+// whether it's a WebSocket upgrade); ConnectAndServe picks one at
+// connect time, falling back to polling if the upgrade is refused.
+type Transport interface {
+	// ServeSession handles one inbound HTTP request that is part of a
+	// session's reverse channel: dispatching response frames it
+	// carries to already-pending requests, and writing new request
+	// frames (waiting for them, if the transport is long-lived) to w.
+	ServeSession(srv *Server, session *Session, w http.ResponseWriter, r *http.Request)
+}
+
+// isWebSocketUpgrade reports whether r is asking to upgrade to the
+// WebSocket protocol.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// WebSocketTransport carries framed requests and responses over a
+// single persistent WebSocket connection instead of repeated POSTs,
+// avoiding idle-timeout reconnects and per-request HTTP overhead.
+type WebSocketTransport struct {
+	Upgrader websocket.Upgrader
+}
+
+func (t WebSocketTransport) ServeSession(srv *Server, session *Session, w http.ResponseWriter, r *http.Request) {
+	conn, err := t.Upgrader.Upgrade(w, r, http.Header{"X-Session": []string{r.Header.Get("X-Session")}})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	var writeMu sync.Mutex
+	sendFrame := func(streamID uint32, kind byte, payload []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return conn.WriteMessage(websocket.BinaryMessage, encodeFrame(streamID, kind, payload))
+	}
+
+	// release is how the read loop tells the dispatch loop below that a
+	// stream finished, so session.MaxConcurrentStreams is honored here
+	// too (PollTransport gets this for free by only gathering up to the
+	// limit per poll; a WebSocket has no such natural boundary).
+	maxStreams := session.MaxConcurrentStreams()
+	release := make(chan struct{}, maxStreams)
+
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			streamID, kind, payload, err := decodeFrame(data)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			dispatchResponseFrame(session, streamID, kind, payload)
+			if kind == frameEnd {
+				release <- struct{}{}
+			}
+		}
+	}()
+
+	active := 0
+	for {
+		requestsCh := session.Requests
+		if active >= maxStreams {
+			requestsCh = nil
+		}
+		select {
+		case <-readErr:
+			return
+		case <-session.closed:
+			// the session is gone on purpose (explicit Close, idle
+			// timeout, or Shutdown): say so with a real WS close frame
+			// instead of just dropping the TCP connection, so the
+			// client's read loop sees a clean close rather than an
+			// abnormal one and can report ErrSessionClosed.
+			msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+			conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeWriteWait))
+			return
+		case streamID := <-session.cancels:
+			if err := sendFrame(streamID, frameCancel, nil); err != nil {
+				return
+			}
+		case <-release:
+			active--
+		case req, ok := <-requestsCh:
+			if !ok {
+				// only Close closes Requests, so this is the same
+				// deliberate end of the session as the case above.
+				msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+				conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeWriteWait))
+				return
+			}
+			var buf bytes.Buffer
+			if err := req.HTTP.Write(&buf); err != nil {
+				req.Response <- Response{Err: err}
+				continue
+			}
+			rememberPending(session, req)
+			if err := sendFrame(req.StreamID, frameData, buf.Bytes()); err != nil {
+				return
+			}
+			active++
+		}
+	}
+}
+
+// maxStreamBufferBytes bounds how much of an unread response body
+// dispatchResponseFrame will buffer for a stream before giving up on
+// it. dispatchResponseFrame runs on the one goroutine that also carries
+// every other stream's frames (PollTransport's single ServeSession call,
+// or WebSocketTransport's one read loop), so it must never block on a
+// caller that isn't reading resp.Body.
+const maxStreamBufferBytes = 1 << 20 // 1MiB
+
+// errStreamBufferExceeded is what a streamBody's reader sees once its
+// writer has given up on a stream for buffering too much unread data.
+var errStreamBufferExceeded = errors.New("reversehttp: response body exceeded buffering limit")
+
+// streamBody is an io.Reader fed by dispatchResponseFrame in place of an
+// io.Pipe. Unlike a pipe, writing into it never blocks: bytes are
+// appended to an in-memory buffer that the reader (http.ReadResponse,
+// then whatever the caller does with resp.Body) drains at its own pace,
+// up to maxStreamBufferBytes. This keeps a caller that never reads a
+// response body from wedging the shared dispatch loop, at the cost of
+// dropping that one stream if it's abused.
+type streamBody struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	buf     bytes.Buffer
+	closed  bool
+	dropped bool
+}
+
+func newStreamBody() *streamBody {
+	b := &streamBody{}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// write appends payload without blocking the dispatch loop. If that
+// would grow the unread buffer past maxStreamBufferBytes, the stream is
+// dropped instead: its reader will see errStreamBufferExceeded once it
+// has drained whatever was already buffered.
+func (b *streamBody) write(payload []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.dropped || b.closed {
+		return
+	}
+	if b.buf.Len()+len(payload) > maxStreamBufferBytes {
+		b.dropped = true
+		b.cond.Broadcast()
+		return
+	}
+	b.buf.Write(payload)
+	b.cond.Broadcast()
+}
+
+func (b *streamBody) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.cond.Broadcast()
+}
+
+func (b *streamBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.buf.Len() == 0 && !b.closed && !b.dropped {
+		b.cond.Wait()
+	}
+	if b.buf.Len() > 0 {
+		return b.buf.Read(p)
+	}
+	if b.dropped {
+		return 0, errStreamBufferExceeded
+	}
+	return 0, io.EOF
+}
+
+// dispatchResponseFrame handles one response frame for streamID. The
+// first frame for a stream carries the HTTP header block (and perhaps
+// the start of the body); it opens a streamBody, delivers a
+// *http.Response whose Body reads from it, and lets the caller start
+// consuming it immediately instead of waiting for the whole response.
+// Later frames feed the streamBody, and a frameEnd frame closes it.
+func dispatchResponseFrame(session *Session, streamID uint32, kind byte, payload []byte) {
+	session.pendingMu.Lock()
+	body, streaming := session.streams[streamID]
+	pendingReq := session.pending[streamID]
+	session.pendingMu.Unlock()
+
+	if kind == frameEnd {
+		if streaming {
+			body.close()
+			session.pendingMu.Lock()
+			delete(session.streams, streamID)
+			delete(session.pending, streamID)
+			session.pendingMu.Unlock()
+		}
+		return
+	}
+
+	if kind != frameData {
+		return
+	}
+
+	if streaming {
+		if len(payload) > 0 {
+			body.write(payload)
+		}
+		return
+	}
+
+	if pendingReq == nil {
+		return
+	}
+
+	// first frame for this stream: start streaming the body in over a
+	// streamBody, and hand the caller a *http.Response as soon as the
+	// header block is parsed rather than waiting for the body to finish.
+	body = newStreamBody()
+	session.pendingMu.Lock()
+	session.streams[streamID] = body
+	session.pendingMu.Unlock()
+
+	go func() {
+		resp, err := http.ReadResponse(bufio.NewReader(body), pendingReq.HTTP)
+		if err != nil {
+			pendingReq.Response <- Response{Err: err}
+			close(pendingReq.Response)
+			return
+		}
+		pendingReq.Response <- Response{HTTP: resp}
+		close(pendingReq.Response)
+	}()
+
+	if len(payload) > 0 {
+		body.write(payload)
+	}
+}
+
+// rememberPending records req as awaiting a response on its stream ID.
+func rememberPending(session *Session, req Request) {
+	session.pendingMu.Lock()
+	reqCopy := req
+	session.pending[req.StreamID] = &reqCopy
+	session.pendingMu.Unlock()
+}
+
+// dialWebSocket attempts to upgrade the session to a WebSocket
+// connection, returning an error if the server doesn't speak it.
+func dialWebSocket(rawURL string) (*websocket.Conn, string, error) {
+	wsURL, err := toWebSocketURL(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	return conn, resp.Header.Get("X-Session"), nil
+}
+
+func toWebSocketURL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	default:
+		return "", fmt.Errorf("reversehttp: cannot derive a WebSocket URL from %q", rawURL)
+	}
+	return u.String(), nil
+}
+
+// serveWebSocket runs handler for every request the server sends over
+// conn until the connection closes.
+func serveWebSocket(conn *websocket.Conn, handler http.Handler) error {
+	defer conn.Close()
+
+	var writeMu sync.Mutex
+	sendFrame := func(streamID uint32, kind byte, payload []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return conn.WriteMessage(websocket.BinaryMessage, encodeFrame(streamID, kind, payload))
+	}
+
+	cancels := newCancelRegistry()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return ErrSessionClosed
+			}
+			return err
+		}
+		streamID, kind, payload, err := decodeFrame(data)
+		if err != nil {
+			return err
+		}
+
+		if kind == frameCancel {
+			cancels.cancel(streamID)
+			continue
+		}
+
+		serverReq, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(payload)))
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if !cancels.register(streamID, cancel) {
+			cancel()
+		}
+		serverReq = serverReq.WithContext(ctx)
+
+		wg.Add(1)
+		go func(streamID uint32, serverReq *http.Request) {
+			defer wg.Done()
+			defer cancels.done(streamID)
+			rw := &ResponseWriter{w: &frameFlusher{streamID: streamID, sendFrame: sendFrame}}
+			handler.ServeHTTP(rw, serverReq)
+			rw.finish()
+			sendFrame(streamID, frameEnd, nil)
+		}(streamID, serverReq)
+	}
+}